@@ -2,47 +2,64 @@ package instance
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 
 	bmcloud "github.com/cloudfoundry/bosh-micro-cli/cloud"
+	bmconfig "github.com/cloudfoundry/bosh-micro-cli/config"
+	bmdisk "github.com/cloudfoundry/bosh-micro-cli/deployer/disk"
 	bmregistry "github.com/cloudfoundry/bosh-micro-cli/deployer/registry"
 	bmsshtunnel "github.com/cloudfoundry/bosh-micro-cli/deployer/sshtunnel"
 	bmstemcell "github.com/cloudfoundry/bosh-micro-cli/deployer/stemcell"
 	bmvm "github.com/cloudfoundry/bosh-micro-cli/deployer/vm"
 	bmdepl "github.com/cloudfoundry/bosh-micro-cli/deployment"
 	bmeventlog "github.com/cloudfoundry/bosh-micro-cli/eventlogger"
+	bmmanifest "github.com/cloudfoundry/bosh-micro-cli/release/manifest"
 )
 
+// Ref identifies a single instance to create, as derived from the
+// manifest's `instances:` count for a job (e.g. "worker/0", "worker/1").
+type Ref struct {
+	JobName string
+	ID      int
+}
+
 type Manager interface {
 	FindCurrent() ([]Instance, error)
 	Create(
-		jobName string,
-		id int,
+		refs []Ref,
 		deployment bmdepl.Deployment,
 		extractedStemcell bmstemcell.ExtractedStemcell,
 		cloudStemcell bmstemcell.CloudStemcell,
 		registry bmdepl.Registry,
 		sshTunnelConfig bmdepl.SSHTunnel,
+		maxInFlight int,
 		eventLoggerStage bmeventlog.Stage,
-	) (instance Instance, err error)
+	) (instances []Instance, disks []bmdisk.Disk, err error)
 	DeleteAll(
 		pingTimeout time.Duration,
 		pingDelay time.Duration,
+		skipDrain bool,
+		maxInFlight int,
 		eventLoggerStage bmeventlog.Stage,
 	) error
 }
 
 type manager struct {
-	cloud            bmcloud.Cloud
-	vmManager        bmvm.Manager
-	registryServer   bmregistry.Server
-	sshTunnelFactory bmsshtunnel.Factory
-	diskDeployer     DiskDeployer
-	logger           boshlog.Logger
-	logTag           string
+	cloud                  bmcloud.Cloud
+	vmManager              bmvm.Manager
+	registryServer         bmregistry.Server
+	sshTunnelFactory       bmsshtunnel.Factory
+	diskDeployer           DiskDeployer
+	diskRepo               bmdisk.Repo
+	deploymentStateService bmconfig.DeploymentStateService
+	deploymentStateMutex   sync.Mutex
+	logger                 boshlog.Logger
+	logTag                 string
 }
 
 func NewManager(
@@ -51,80 +68,157 @@ func NewManager(
 	registryServer bmregistry.Server,
 	sshTunnelFactory bmsshtunnel.Factory,
 	diskDeployer DiskDeployer,
+	diskRepo bmdisk.Repo,
+	deploymentStateService bmconfig.DeploymentStateService,
 	logger boshlog.Logger,
 ) Manager {
 	return &manager{
-		cloud:            cloud,
-		vmManager:        vmManager,
-		registryServer:   registryServer,
-		sshTunnelFactory: sshTunnelFactory,
-		diskDeployer:     diskDeployer,
-		logger:           logger,
-		logTag:           "vmDeployer",
+		cloud:                  cloud,
+		vmManager:              vmManager,
+		registryServer:         registryServer,
+		sshTunnelFactory:       sshTunnelFactory,
+		diskDeployer:           diskDeployer,
+		diskRepo:               diskRepo,
+		deploymentStateService: deploymentStateService,
+		logger:                 logger,
+		logTag:                 "vmDeployer",
 	}
 }
 
 func (m *manager) FindCurrent() ([]Instance, error) {
 	instances := []Instance{}
 
-	// Only one current instance will exist (for now)
-	vm, found, err := m.vmManager.FindCurrent()
+	deploymentState, err := m.deploymentStateService.Load()
 	if err != nil {
-		return instances, bosherr.WrapError(err, "Finding currently deployed instances")
+		return instances, bosherr.WrapError(err, "Loading deployment state")
 	}
 
-	if !found {
-		return instances, nil
-	}
+	// Create persists one record per instance it provisioned, so that a
+	// later `bosh-init delete` can find and tear down every VM from a
+	// multi-instance `create-env`, not just the first one.
+	for _, instanceState := range deploymentState.Instances {
+		vm, found, err := m.vmManager.Find(instanceState.VMCID)
+		if err != nil {
+			return instances, bosherr.WrapErrorf(err, "Finding VM '%s' for instance '%s/%d'", instanceState.VMCID, instanceState.JobName, instanceState.ID)
+		}
 
-	// the job name is not stored (yet)
-	instance := NewInstance("unknown", 0, vm, m.vmManager, m.sshTunnelFactory, m.logger)
-	instances = append(instances, instance)
+		if !found {
+			continue
+		}
 
-	return instances, err
+		instance := NewInstance(instanceState.JobName, instanceState.ID, vm, m.vmManager, m.sshTunnelFactory, m.logger)
+		instances = append(instances, instance)
+	}
+
+	return instances, nil
 }
 
 func (m *manager) Create(
-	jobName string,
-	id int,
+	refs []Ref,
 	deployment bmdepl.Deployment,
 	extractedStemcell bmstemcell.ExtractedStemcell,
 	cloudStemcell bmstemcell.CloudStemcell,
 	registry bmdepl.Registry,
 	sshTunnelConfig bmdepl.SSHTunnel,
+	maxInFlight int,
 	eventLoggerStage bmeventlog.Stage,
-) (instance Instance, err error) {
-
+) ([]Instance, []bmdisk.Disk, error) {
 	if !registry.IsEmpty() {
 		registryReadyErrCh := make(chan error)
 		go m.startRegistry(registry, registryReadyErrCh)
 		defer m.registryServer.Stop()
 
-		err = <-registryReadyErrCh
-		if err != nil {
-			return instance, bosherr.WrapError(err, "Starting registry")
+		if err := <-registryReadyErrCh; err != nil {
+			return nil, nil, bosherr.WrapError(err, "Starting registry")
 		}
 	}
 
+	// Snapshotted once for the whole batch: every instance in this `create-env`
+	// gets the same disk-locality hint, and a new disk deployed by one
+	// instance's creation must not change where its siblings land.
+	diskCIDs, err := m.existingDiskCIDs()
+	if err != nil {
+		return nil, nil, bosherr.WrapError(err, "Listing existing disk CIDs")
+	}
+
+	// Promoting the stemcell as current is a one-time, deployment-wide
+	// operation; doing it per-instance would race N copies of the same call
+	// against the same cloudStemcell value.
+	err = eventLoggerStage.PerformStep(fmt.Sprintf("Promoting stemcell as current '%s'", cloudStemcell.CID()), func() error {
+		return cloudStemcell.PromoteAsCurrent()
+	})
+	if err != nil {
+		return nil, nil, bosherr.WrapErrorf(err, "Promoting stemcell as current '%s'", cloudStemcell.CID())
+	}
+
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+
+	instances := make([]Instance, len(refs))
+	disks := make([]bmdisk.Disk, len(refs))
+	errs := make([]error, len(refs))
+
+	throttle := make(chan struct{}, maxInFlight)
+	var wg sync.WaitGroup
+
+	for i, ref := range refs {
+		wg.Add(1)
+		throttle <- struct{}{}
+
+		go func(i int, ref Ref) {
+			defer wg.Done()
+			defer func() { <-throttle }()
+
+			instanceStage := eventLoggerStage.NewStage(fmt.Sprintf("instance '%s/%d'", ref.JobName, ref.ID))
+
+			instance, disk, err := m.createOne(ref, deployment, extractedStemcell, cloudStemcell, registry, sshTunnelConfig, diskCIDs, instanceStage)
+			instances[i] = instance
+			disks[i] = disk
+			if err != nil {
+				errs[i] = bosherr.WrapErrorf(err, "Creating instance '%s/%d'", ref.JobName, ref.ID)
+			}
+		}(i, ref)
+	}
+
+	wg.Wait()
+
+	return instances, disks, joinErrors(errs)
+}
+
+func (m *manager) createOne(
+	ref Ref,
+	deployment bmdepl.Deployment,
+	extractedStemcell bmstemcell.ExtractedStemcell,
+	cloudStemcell bmstemcell.CloudStemcell,
+	registry bmdepl.Registry,
+	sshTunnelConfig bmdepl.SSHTunnel,
+	diskCIDs []string,
+	eventLoggerStage bmeventlog.Stage,
+) (instance Instance, disk bmdisk.Disk, err error) {
+	var stemcellManifest bmmanifest.Manifest = extractedStemcell.Manifest()
+
 	var vm bmvm.VM
-	stepName := fmt.Sprintf("Creating VM for instance '%s/%d' from stemcell '%s'", jobName, id, cloudStemcell.CID())
+	stepName := fmt.Sprintf("Creating VM for instance '%s/%d' from stemcell '%s'", ref.JobName, ref.ID, cloudStemcell.CID())
 	err = eventLoggerStage.PerformStep(stepName, func() error {
-		vm, err = m.vmManager.Create(cloudStemcell, deployment)
+		vm, err = m.vmManager.Create(cloudStemcell, deployment, diskCIDs, stemcellManifest.StemcellAPIVersion)
 		if err != nil {
 			return bosherr.WrapError(err, "Creating VM")
 		}
 
-		if err = cloudStemcell.PromoteAsCurrent(); err != nil {
-			return bosherr.WrapErrorf(err, "Promoting stemcell as current '%s'", cloudStemcell.CID())
-		}
-
 		return nil
 	})
 	if err != nil {
-		return instance, err
+		return instance, disk, err
+	}
+
+	// Recorded so that a later `bosh-init delete` can find every instance
+	// from this batch, not just the first one (see FindCurrent).
+	if err := m.saveInstanceState(ref, vm); err != nil {
+		return instance, disk, bosherr.WrapErrorf(err, "Saving state for instance '%s/%d'", ref.JobName, ref.ID)
 	}
 
-	instance = NewInstance(jobName, id, vm, m.vmManager, m.sshTunnelFactory, m.logger)
+	instance = NewInstance(ref.JobName, ref.ID, vm, m.vmManager, m.sshTunnelFactory, m.logger)
 
 	sshTunnelOptions := bmsshtunnel.Options{
 		Host:              sshTunnelConfig.Host,
@@ -137,30 +231,53 @@ func (m *manager) Create(
 	}
 
 	if err := instance.WaitUntilReady(sshTunnelOptions, eventLoggerStage); err != nil {
-		return instance, bosherr.WrapError(err, "Waiting until instance is ready")
+		return instance, disk, bosherr.WrapError(err, "Waiting until instance is ready")
 	}
 
 	// disk creation requires knowledge of the vm, so we can't use the diskManager.Create pattern
-	diskPool, err := deployment.DiskPool(jobName)
+	diskPool, err := deployment.DiskPool(ref.JobName)
 	if err != nil {
-		return instance, bosherr.WrapError(err, "Getting disk pool")
+		return instance, disk, bosherr.WrapError(err, "Getting disk pool")
 	}
 
-	err = m.diskDeployer.Deploy(diskPool, m.cloud, vm, eventLoggerStage)
+	disk, err = m.diskDeployer.Deploy(diskPool, m.cloud, vm, eventLoggerStage)
 	if err != nil {
-		return instance, bosherr.WrapError(err, "Deploying disk")
+		return instance, disk, bosherr.WrapError(err, "Deploying disk")
+	}
+
+	applySpec := extractedStemcell.ApplySpec()
+	applySpec.StemcellAPIVersion = stemcellManifest.StemcellAPIVersion
+
+	if err = instance.StartJobs(applySpec, deployment, eventLoggerStage); err != nil {
+		return instance, disk, err
 	}
 
-	if err = instance.StartJobs(extractedStemcell.ApplySpec(), deployment, eventLoggerStage); err != nil {
-		return instance, err
+	return instance, disk, nil
+}
+
+// joinErrors aggregates every non-nil error in errs into one, so that a
+// batch of concurrently-created (or -deleted) instances reports all of its
+// failures instead of silently dropping all but the first.
+func joinErrors(errs []error) error {
+	messages := []string{}
+	for _, err := range errs {
+		if err != nil {
+			messages = append(messages, err.Error())
+		}
 	}
 
-	return instance, err
+	if len(messages) == 0 {
+		return nil
+	}
+
+	return bosherr.Errorf("%d of %d instances failed:\n%s", len(messages), len(errs), strings.Join(messages, "\n"))
 }
 
 func (m *manager) DeleteAll(
 	pingTimeout time.Duration,
 	pingDelay time.Duration,
+	skipDrain bool,
+	maxInFlight int,
 	eventLoggerStage bmeventlog.Stage,
 ) error {
 	instances, err := m.FindCurrent()
@@ -168,12 +285,89 @@ func (m *manager) DeleteAll(
 		return err
 	}
 
-	for _, instance := range instances {
-		if err = instance.Delete(pingTimeout, pingDelay, eventLoggerStage); err != nil {
-			return bosherr.WrapErrorf(err, "Deleting existing instance '%s/%d'", instance.JobName(), instance.ID())
-		}
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+
+	errs := make([]error, len(instances))
+	throttle := make(chan struct{}, maxInFlight)
+	var wg sync.WaitGroup
+
+	for i, instance := range instances {
+		wg.Add(1)
+		throttle <- struct{}{}
+
+		go func(i int, instance Instance) {
+			defer wg.Done()
+			defer func() { <-throttle }()
+
+			instanceStage := eventLoggerStage.NewStage(fmt.Sprintf("instance '%s/%d'", instance.JobName(), instance.ID()))
+
+			if err := instance.Delete(pingTimeout, pingDelay, skipDrain, instanceStage); err != nil {
+				errs[i] = bosherr.WrapErrorf(err, "Deleting existing instance '%s/%d'", instance.JobName(), instance.ID())
+			}
+		}(i, instance)
+	}
+
+	wg.Wait()
+
+	if err := joinErrors(errs); err != nil {
+		return err
+	}
+
+	return m.clearInstanceState()
+}
+
+// saveInstanceState records ref's VM CID in the deployment state so that a
+// later FindCurrent (e.g. from `bosh-init delete`) can discover it. Guarded
+// by deploymentStateMutex because Create saves concurrently across the
+// batch's instances.
+func (m *manager) saveInstanceState(ref Ref, vm bmvm.VM) error {
+	m.deploymentStateMutex.Lock()
+	defer m.deploymentStateMutex.Unlock()
+
+	deploymentState, err := m.deploymentStateService.Load()
+	if err != nil {
+		return bosherr.WrapError(err, "Loading deployment state")
 	}
-	return nil
+
+	deploymentState.Instances = append(deploymentState.Instances, bmconfig.InstanceState{
+		JobName: ref.JobName,
+		ID:      ref.ID,
+		VMCID:   vm.CID(),
+	})
+
+	return m.deploymentStateService.Save(deploymentState)
+}
+
+// clearInstanceState drops every recorded instance once DeleteAll has
+// successfully torn them all down, so a subsequent FindCurrent reports none.
+func (m *manager) clearInstanceState() error {
+	m.deploymentStateMutex.Lock()
+	defer m.deploymentStateMutex.Unlock()
+
+	deploymentState, err := m.deploymentStateService.Load()
+	if err != nil {
+		return bosherr.WrapError(err, "Loading deployment state")
+	}
+
+	deploymentState.Instances = nil
+
+	return m.deploymentStateService.Save(deploymentState)
+}
+
+func (m *manager) existingDiskCIDs() ([]string, error) {
+	disks, err := m.diskRepo.All()
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Getting existing disks")
+	}
+
+	diskCIDs := []string{}
+	for _, disk := range disks {
+		diskCIDs = append(diskCIDs, disk.CID())
+	}
+
+	return diskCIDs, nil
 }
 
 func (m *manager) startRegistry(registry bmdepl.Registry, readyErrCh chan error) {
@@ -7,6 +7,12 @@ type Manifest struct {
 	CommitHash         string `yaml:"commit_hash"`
 	UncommittedChanges bool   `yaml:"uncommitted_changes"`
 
+	// StemcellAPIVersion is the CPI API version the release's stemcell
+	// declares support for (e.g. `api_version: 2` in its stemcell
+	// manifest). A zero value means the stemcell predates API
+	// versioning and only CPI v1 calls should be made against it.
+	StemcellAPIVersion int `yaml:"stemcell_api_version"`
+
 	Jobs     []JobRef     `yaml:"jobs"`
 	Packages []PackageRef `yaml:"packages"`
 }
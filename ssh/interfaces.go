@@ -21,6 +21,11 @@ type SCPRunner interface {
 type ConnectionOpts struct {
 	PrivateKey string
 
+	// KnownHostsPath points at a known_hosts file used to verify instance
+	// and gateway host keys for the native SSH backend. Defaults to
+	// "~/.ssh/known_hosts" when empty.
+	KnownHostsPath string
+
 	GatewayDisable bool
 
 	GatewayUsername       string
@@ -0,0 +1,86 @@
+package ssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshdir "github.com/cloudfoundry/bosh-init/director"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newClientConfig(connOpts ConnectionOpts, result boshdir.SSHResult) (*ssh.ClientConfig, error) {
+	signer, err := parsePrivateKey(connOpts.PrivateKey)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Parsing private key")
+	}
+
+	hostKeyCallback, err := hostKeyCallback(connOpts.KnownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User: result.Username,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+			ssh.Password(result.Password),
+		},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+func newGatewayClientConfig(connOpts ConnectionOpts) (*ssh.ClientConfig, error) {
+	keyPEM := connOpts.PrivateKey
+	if keyPath := connOpts.GatewayPrivateKeyPath; keyPath != "" {
+		keyBytes, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return nil, bosherr.WrapErrorf(err, "Reading gateway private key '%s'", keyPath)
+		}
+		keyPEM = string(keyBytes)
+	}
+
+	signer, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Parsing gateway private key")
+	}
+
+	hostKeyCallback, err := hostKeyCallback(connOpts.KnownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.ClientConfig{
+		User: connOpts.GatewayUsername,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+func parsePrivateKey(pemBlock string) (ssh.Signer, error) {
+	return ssh.ParsePrivateKey([]byte(pemBlock))
+}
+
+// hostKeyCallback verifies instance and gateway host keys against a
+// known_hosts file instead of trusting whatever key the far end presents.
+// knownHostsPath defaults to "~/.ssh/known_hosts" when empty.
+func hostKeyCallback(knownHostsPath string) (ssh.HostKeyCallback, error) {
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, bosherr.WrapError(err, "Determining user home directory")
+		}
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	callback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, bosherr.WrapErrorf(err, "Loading known_hosts file '%s'", knownHostsPath)
+	}
+
+	return callback, nil
+}
@@ -0,0 +1,117 @@
+package ssh
+
+import (
+	"net"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshdir "github.com/cloudfoundry/bosh-init/director"
+	"golang.org/x/crypto/ssh"
+)
+
+// NativeRunner runs commands over an in-process SSH client, dialing directly
+// (and through a gateway, when configured) instead of forking the system
+// `ssh` binary. This keeps bosh-init working on platforms without an `ssh`
+// client installed and lets exit codes be read directly off the session.
+type NativeRunner struct {
+	writer Writer
+	logger boshlog.Logger
+	logTag string
+}
+
+func NewNativeRunner(writer Writer, logger boshlog.Logger) NativeRunner {
+	return NativeRunner{
+		writer: writer,
+		logger: logger,
+		logTag: "nativeRunner",
+	}
+}
+
+func (r NativeRunner) Run(connOpts ConnectionOpts, result boshdir.SSHResult, commands []string) error {
+	client, closeGateway, err := r.dial(connOpts, result)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Dialing instance '%s'", result.Host)
+	}
+	if closeGateway != nil {
+		defer closeGateway()
+	}
+	defer client.Close()
+
+	instanceWriter := r.writer.ForInstance(result.Job, result.IndexOrID, result.Host)
+
+	for _, cmd := range commands {
+		err := r.runOne(client, cmd, instanceWriter)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r NativeRunner) runOne(client *ssh.Client, cmd string, instanceWriter InstanceWriter) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return bosherr.WrapError(err, "Starting SSH session")
+	}
+	defer session.Close()
+
+	session.Stdout = instanceWriter.Stdout()
+	session.Stderr = instanceWriter.Stderr()
+
+	runErr := session.Run(cmd)
+
+	exitStatus := 0
+	if exitErr, ok := runErr.(*ssh.ExitError); ok {
+		exitStatus = exitErr.ExitStatus()
+		runErr = nil
+	}
+
+	instanceWriter.End(exitStatus, runErr)
+
+	return runErr
+}
+
+// dial establishes the client connection to result.Host, transparently
+// chaining through connOpts' gateway when one is configured. The returned
+// closeGateway func closes the bastion connection once the tunneled client
+// is done with it, and is nil when no gateway was used.
+func (r NativeRunner) dial(connOpts ConnectionOpts, result boshdir.SSHResult) (client *ssh.Client, closeGateway func() error, err error) {
+	clientConfig, err := newClientConfig(connOpts, result)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addr := net.JoinHostPort(result.Host, "22")
+
+	if connOpts.GatewayDisable || connOpts.GatewayHost == "" {
+		client, err = ssh.Dial("tcp", addr, clientConfig)
+		return client, nil, err
+	}
+
+	gatewayConfig, err := newGatewayClientConfig(connOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gatewayAddr := net.JoinHostPort(connOpts.GatewayHost, "22")
+
+	gatewayClient, err := ssh.Dial("tcp", gatewayAddr, gatewayConfig)
+	if err != nil {
+		return nil, nil, bosherr.WrapErrorf(err, "Dialing gateway '%s'", connOpts.GatewayHost)
+	}
+
+	conn, err := gatewayClient.Dial("tcp", addr)
+	if err != nil {
+		gatewayClient.Close()
+		return nil, nil, bosherr.WrapErrorf(err, "Dialing instance '%s' through gateway", result.Host)
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err != nil {
+		gatewayClient.Close()
+		return nil, nil, bosherr.WrapErrorf(err, "Establishing SSH connection to '%s' through gateway", result.Host)
+	}
+
+	return ssh.NewClient(clientConn, chans, reqs), gatewayClient.Close, nil
+}
@@ -0,0 +1,94 @@
+package ssh
+
+import (
+	"os"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshdir "github.com/cloudfoundry/bosh-init/director"
+	"github.com/pkg/sftp"
+)
+
+// NativeSCPRunner copies files over an in-process SFTP session rather than
+// forking the system `scp` binary, reusing the same dial/gateway logic as
+// NativeRunner.
+type NativeSCPRunner struct {
+	logger boshlog.Logger
+	logTag string
+}
+
+func NewNativeSCPRunner(logger boshlog.Logger) NativeSCPRunner {
+	return NativeSCPRunner{
+		logger: logger,
+		logTag: "nativeSCPRunner",
+	}
+}
+
+func (r NativeSCPRunner) Run(connOpts ConnectionOpts, result boshdir.SSHResult, args SCPArgs) error {
+	if len(args.Args()) < 2 {
+		return bosherr.Errorf("Expected SCP args to contain a source and a destination, got %d", len(args.Args()))
+	}
+
+	client, closeGateway, err := NewNativeRunner(nil, r.logger).dial(connOpts, result)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Dialing instance '%s'", result.Host)
+	}
+	if closeGateway != nil {
+		defer closeGateway()
+	}
+	defer client.Close()
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return bosherr.WrapError(err, "Starting SFTP session")
+	}
+	defer sftpClient.Close()
+
+	if args.IsUpload() {
+		return r.upload(sftpClient, args.Args()[0], args.Args()[1])
+	}
+
+	return r.download(sftpClient, args.Args()[0], args.Args()[1])
+}
+
+func (r NativeSCPRunner) upload(client *sftp.Client, localPath, remotePath string) error {
+	localFile, err := os.Open(localPath)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Opening local file '%s'", localPath)
+	}
+	defer localFile.Close()
+
+	remoteFile, err := client.Create(remotePath)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Creating remote file '%s'", remotePath)
+	}
+	defer remoteFile.Close()
+
+	_, err = remoteFile.ReadFrom(localFile)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Copying file to '%s'", remotePath)
+	}
+
+	return nil
+}
+
+func (r NativeSCPRunner) download(client *sftp.Client, remotePath, localPath string) error {
+	remoteFile, err := client.Open(remotePath)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Opening remote file '%s'", remotePath)
+	}
+	defer remoteFile.Close()
+
+	localFile, err := os.Create(localPath)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Creating local file '%s'", localPath)
+	}
+	defer localFile.Close()
+
+	_, err = remoteFile.WriteTo(localFile)
+	if err != nil {
+		return bosherr.WrapErrorf(err, "Copying file from '%s'", remotePath)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package ssh
+
+import (
+	"flag"
+	"os"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+)
+
+const (
+	// BackendExec forks the system `ssh`/`scp` binaries. This remains the
+	// default so existing installs keep behaving exactly as before.
+	BackendExec = "exec"
+
+	// BackendNative speaks the SSH protocol in-process via
+	// golang.org/x/crypto/ssh, requiring no `ssh` client on the operator's
+	// machine.
+	BackendNative = "native"
+
+	backendEnvVar = "SSH_BACKEND"
+
+	backendFlagName = "ssh-backend"
+)
+
+// RegisterBackendFlag registers the `--ssh-backend=native|exec` flag on fs,
+// returning the string it will be parsed into. Callers pass the resulting
+// value to NewRunner/NewSCPRunner once flags have been parsed; an unset
+// flag falls back to SSH_BACKEND, then BackendExec, exactly as passing ""
+// does.
+func RegisterBackendFlag(fs *flag.FlagSet) *string {
+	return fs.String(backendFlagName, "", "SSH backend to use for `bosh-init ssh` ([native|exec], default exec, overridable via SSH_BACKEND)")
+}
+
+// NewRunner returns the Runner for the requested backend ("native" or
+// "exec"). An empty backend falls back to the SSH_BACKEND env var, and then
+// to BackendExec.
+func NewRunner(backend string, execRunner Runner, writer Writer, logger boshlog.Logger) Runner {
+	if resolveBackend(backend) == BackendNative {
+		return NewNativeRunner(writer, logger)
+	}
+
+	return execRunner
+}
+
+// NewSCPRunner returns the SCPRunner for the requested backend ("native" or
+// "exec"). An empty backend falls back to the SSH_BACKEND env var, and then
+// to BackendExec.
+func NewSCPRunner(backend string, execSCPRunner SCPRunner, logger boshlog.Logger) SCPRunner {
+	if resolveBackend(backend) == BackendNative {
+		return NewNativeSCPRunner(logger)
+	}
+
+	return execSCPRunner
+}
+
+func resolveBackend(backend string) string {
+	if backend != "" {
+		return backend
+	}
+
+	if envBackend := os.Getenv(backendEnvVar); envBackend != "" {
+		return envBackend
+	}
+
+	return BackendExec
+}